@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ProjectLeaser leases a GCP project for the lifetime of a deploy.
+// Implementations let CreateDeployer run against a pooled project instead of
+// a fixed one, and let tests exercise the acquire/heartbeat/release
+// lifecycle without hitting a real Boskos server.
+type ProjectLeaser interface {
+	// Acquire leases and returns a project.
+	Acquire(ctx context.Context) (project string, err error)
+	// Heartbeat keeps project's lease alive.
+	Heartbeat(ctx context.Context, project string) error
+	// Release gives project back to the pool, marking it dirty if the
+	// deploy that leased it failed.
+	Release(ctx context.Context, project string, dirty bool) error
+}
+
+// NoOpLeaser is a ProjectLeaser that always hands out the same fixed
+// project and does nothing on Heartbeat or Release. Use it for local runs
+// and tests that don't need a Boskos server.
+type NoOpLeaser struct {
+	Project string
+}
+
+// Acquire returns l.Project.
+func (l NoOpLeaser) Acquire(ctx context.Context) (string, error) {
+	return l.Project, nil
+}
+
+// Heartbeat does nothing.
+func (l NoOpLeaser) Heartbeat(ctx context.Context, project string) error {
+	return nil
+}
+
+// Release does nothing.
+func (l NoOpLeaser) Release(ctx context.Context, project string, dirty bool) error {
+	return nil
+}
+
+// BoskosLeaser leases GCP projects from a Boskos server
+// (https://github.com/kubernetes-sigs/boskos), the resource pool Prow uses
+// to share a fixed set of GCP projects across many concurrent CI jobs.
+type BoskosLeaser struct {
+	// Host is the base URL of the Boskos server, e.g.
+	// "http://boskos.test-pods.svc.cluster.local".
+	Host string
+	// ResourceType is the Boskos resource type to acquire, e.g.
+	// "gke-project".
+	ResourceType string
+	// Owner identifies this client to Boskos. Defaults to "gke-deploy".
+	Owner string
+	// Client is the HTTP client used for requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+type boskosResource struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	Owner string `json:"owner"`
+}
+
+// Acquire requests a free resource of l.ResourceType from Boskos and returns
+// its name.
+func (l BoskosLeaser) Acquire(ctx context.Context) (string, error) {
+	v := url.Values{
+		"type":  {l.ResourceType},
+		"state": {"free"},
+		"dest":  {"busy"},
+		"owner": {l.owner()},
+	}
+	var res boskosResource
+	if err := l.do(ctx, "/acquire", v, &res); err != nil {
+		return "", fmt.Errorf("failed to acquire a %q resource from boskos: %v", l.ResourceType, err)
+	}
+	return res.Name, nil
+}
+
+// Heartbeat tells Boskos that project is still in use.
+func (l BoskosLeaser) Heartbeat(ctx context.Context, project string) error {
+	v := url.Values{
+		"name":  {project},
+		"owner": {l.owner()},
+		"state": {"busy"},
+	}
+	if err := l.do(ctx, "/update", v, nil); err != nil {
+		return fmt.Errorf("failed to heartbeat boskos resource %q: %v", project, err)
+	}
+	return nil
+}
+
+// Release gives project back to the Boskos pool.
+func (l BoskosLeaser) Release(ctx context.Context, project string, dirty bool) error {
+	dest := "free"
+	if dirty {
+		dest = "dirty"
+	}
+	v := url.Values{
+		"name":  {project},
+		"owner": {l.owner()},
+		"dest":  {dest},
+	}
+	if err := l.do(ctx, "/release", v, nil); err != nil {
+		return fmt.Errorf("failed to release boskos resource %q: %v", project, err)
+	}
+	return nil
+}
+
+func (l BoskosLeaser) owner() string {
+	if l.Owner != "" {
+		return l.Owner
+	}
+	return "gke-deploy"
+}
+
+func (l BoskosLeaser) client() *http.Client {
+	if l.Client != nil {
+		return l.Client
+	}
+	return http.DefaultClient
+}
+
+// do issues a POST to path on the Boskos server with query as the query
+// string, decoding a JSON response into out when out is non-nil.
+func (l BoskosLeaser) do(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.Host+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("boskos returned status %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
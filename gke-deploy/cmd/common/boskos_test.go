@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBoskosLeaser(t *testing.T) {
+	var gotAcquire, gotUpdate, gotRelease url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/acquire":
+			gotAcquire = r.URL.Query()
+			w.Write([]byte(`{"name":"leased-project","type":"gke-project","state":"busy","owner":"gke-deploy"}`))
+		case "/update":
+			gotUpdate = r.URL.Query()
+			w.Write([]byte(`{}`))
+		case "/release":
+			gotRelease = r.URL.Query()
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	l := BoskosLeaser{Host: srv.URL, ResourceType: "gke-project"}
+	ctx := context.Background()
+
+	project, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+	if project != "leased-project" {
+		t.Errorf("Acquire() = %q, want %q", project, "leased-project")
+	}
+	if got := gotAcquire.Get("type"); got != "gke-project" {
+		t.Errorf("acquire request type = %q, want %q", got, "gke-project")
+	}
+
+	if err := l.Heartbeat(ctx, project); err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+	if got := gotUpdate.Get("name"); got != project {
+		t.Errorf("update request name = %q, want %q", got, project)
+	}
+	if got := gotUpdate.Get("state"); got != "busy" {
+		t.Errorf("update request state = %q, want %q", got, "busy")
+	}
+
+	if err := l.Release(ctx, project, true); err != nil {
+		t.Fatalf("Release() returned error: %v", err)
+	}
+	if got := gotRelease.Get("dest"); got != "dirty" {
+		t.Errorf("release request dest = %q, want %q", got, "dirty")
+	}
+}
+
+func TestNoOpLeaser(t *testing.T) {
+	l := NoOpLeaser{Project: "local-project"}
+	ctx := context.Background()
+
+	project, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %v", err)
+	}
+	if project != "local-project" {
+		t.Errorf("Acquire() = %q, want %q", project, "local-project")
+	}
+	if err := l.Heartbeat(ctx, project); err != nil {
+		t.Errorf("Heartbeat() returned error: %v", err)
+	}
+	if err := l.Release(ctx, project, false); err != nil {
+		t.Errorf("Release() returned error: %v", err)
+	}
+}
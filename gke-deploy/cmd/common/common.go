@@ -3,16 +3,27 @@ package common
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-builders/gke-deploy/deployer"
 	"github.com/GoogleCloudPlatform/cloud-builders/gke-deploy/services"
 	applicationsv1beta1 "github.com/kubernetes-sigs/application/pkg/apis/app/v1beta1"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/option"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // BranchInBranches tests a branch to see if it's in a slice of branches
@@ -58,6 +69,56 @@ func CreateApplicationLinksListFromEqualDelimitedStrings(applicationLinks []stri
 	return asList, nil
 }
 
+// AppNamespaceMode selects how the Application CR (and its RBAC) is
+// installed relative to namespaces.
+type AppNamespaceMode int
+
+const (
+	// AppCluster installs a single Application CR cluster-wide. This is the
+	// historical default.
+	AppCluster AppNamespaceMode = iota
+	// AppNamespace installs the Application CR into a single target
+	// namespace.
+	AppNamespace
+	// AppMulti installs a separate Application CR, with its own links,
+	// descriptor, and owner references, into each of
+	// DeployerOptions.AppNamespaces.
+	AppMulti
+)
+
+// CreateApplicationLinksMapFromEqualDelimitedStrings creates a
+// map[string][]applicationsv1beta1.Link from a slice of "ns/key=value"
+// strings, where ns scopes the link to a single target namespace and
+// key=value is parsed exactly as
+// CreateApplicationLinksListFromEqualDelimitedStrings parses its entries.
+// Entries without a "ns/" prefix are grouped under the empty string, which
+// AppCluster mode reads as the cluster-wide link set.
+func CreateApplicationLinksMapFromEqualDelimitedStrings(applicationLinks []string) (map[string][]applicationsv1beta1.Link, error) {
+	linksByNamespace := make(map[string][]applicationsv1beta1.Link)
+	for _, nsKeyValue := range applicationLinks {
+		p := strings.TrimSpace(nsKeyValue)
+		p = strings.Trim(p, ",")
+		if p == "" {
+			continue
+		}
+		ns := ""
+		key := p
+		if eq := strings.Index(p, "="); eq >= 0 {
+			key = p[:eq]
+		}
+		if i := strings.Index(key, "/"); i >= 0 {
+			ns = strings.TrimSpace(p[:i])
+			p = p[i+1:]
+		}
+		links, err := CreateApplicationLinksListFromEqualDelimitedStrings([]string{p})
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %v", ns, err)
+		}
+		linksByNamespace[ns] = append(linksByNamespace[ns], links...)
+	}
+	return linksByNamespace, nil
+}
+
 // CreateMapFromEqualDelimitedStrings creates a map[string]string from a slice
 // of "="-delimited strings.
 func CreateMapFromEqualDelimitedStrings(labels []string) (map[string]string, error) {
@@ -85,32 +146,446 @@ func CreateMapFromEqualDelimitedStrings(labels []string) (map[string]string, err
 	return labelsMap, nil
 }
 
-// CreateDeployer creates a Deployer with initialized clients.
-func CreateDeployer(ctx context.Context, useGcloud, verbose bool) (*deployer.Deployer, error) {
-	c, err := services.NewClients(ctx, useGcloud, verbose)
+// AuthMode selects how CreateDeployer authenticates to the target cluster.
+type AuthMode int
+
+const (
+	// Gcloud shells out to the gcloud SDK to resolve credentials and cluster
+	// context. This is the historical default.
+	Gcloud AuthMode = iota
+	// ADC builds an in-process GKE client authenticated with Application
+	// Default Credentials.
+	ADC
+	// WorkloadIdentity exchanges the Pod's Workload Identity bindings for a
+	// token source, without reading any credentials from disk.
+	WorkloadIdentity
+	// ServiceAccountKey authenticates using the service account key file at
+	// DeployerOptions.ServiceAccountKeyFile.
+	ServiceAccountKey
+	// Kubeconfig uses an existing kubeconfig file/context and skips GKE
+	// cluster resolution entirely.
+	Kubeconfig
+)
+
+// ClusterRef identifies the GKE cluster to deploy to when AuthMode is
+// anything other than Gcloud or Kubeconfig.
+type ClusterRef struct {
+	Project  string
+	Location string
+	Name     string
+}
+
+// DeployerOptions configures CreateDeployer.
+type DeployerOptions struct {
+	// UseGcloud, if true, takes precedence over AuthMode and preserves the
+	// legacy gcloud shell-out behavior.
+	UseGcloud bool
+	Verbose   bool
+
+	// AuthMode selects how to build the in-process Kubernetes client when
+	// UseGcloud is false.
+	AuthMode AuthMode
+	// Cluster identifies the target cluster. Required for every AuthMode
+	// except Kubeconfig. Cluster.Location is ignored when Locations is
+	// non-empty.
+	Cluster ClusterRef
+	// Locations lists candidate cluster locations to try, in order, before
+	// falling back to BackupLocations. Project and Name are taken from
+	// Cluster; only Location varies per candidate. When empty, Cluster is
+	// used as the sole target.
+	Locations []string
+	// BackupLocations is tried, in order, only after every entry in
+	// Locations has failed.
+	BackupLocations []string
+	// LocationSelector controls the order candidate locations are tried in
+	// and which errors are worth retrying against the next one. A nil
+	// LocationSelector is equivalent to &LocationSelector{Order: Sticky}.
+	LocationSelector *LocationSelector
+	// ServiceAccountKeyFile is the path to a service account key file. Only
+	// read when AuthMode is ServiceAccountKey.
+	ServiceAccountKeyFile string
+	// KubeconfigPath overrides the default kubeconfig location. Only read
+	// when AuthMode is Kubeconfig.
+	KubeconfigPath string
+
+	// BoskosHost is the base URL of a Boskos server to lease Cluster.Project
+	// from instead of using a fixed project. Ignored when Leaser is set.
+	BoskosHost string
+	// BoskosResourceType is the Boskos resource type to acquire, e.g.
+	// "gke-project". Required when BoskosHost is set.
+	BoskosResourceType string
+	// BoskosOwner identifies this client to Boskos. Defaults to
+	// "gke-deploy".
+	BoskosOwner string
+	// Leaser overrides the project leaser CreateDeployer uses, e.g. a
+	// NoOpLeaser for local runs or a fake for tests. Defaults to a
+	// BoskosLeaser when BoskosHost is set, otherwise no leasing is done.
+	Leaser ProjectLeaser
+
+	// AppNamespaceMode selects how the Application CR is scoped to
+	// namespaces. Defaults to AppCluster.
+	AppNamespaceMode AppNamespaceMode
+	// AppNamespaces lists the target namespaces to install the Application
+	// CR into. Read for AppNamespace (only the first entry) and AppMulti
+	// (every entry).
+	AppNamespaces []string
+	// AppLinks holds the per-namespace link sets built by
+	// CreateApplicationLinksMapFromEqualDelimitedStrings. The empty string
+	// key is the cluster-wide link set used by AppCluster.
+	AppLinks map[string][]applicationsv1beta1.Link
+}
+
+// projectLeaser returns the ProjectLeaser CreateDeployer should use, or nil
+// if project leasing isn't configured.
+func (opts DeployerOptions) projectLeaser() ProjectLeaser {
+	if opts.Leaser != nil {
+		return opts.Leaser
+	}
+	if opts.BoskosHost == "" {
+		return nil
+	}
+	return BoskosLeaser{
+		Host:         opts.BoskosHost,
+		ResourceType: opts.BoskosResourceType,
+		Owner:        opts.BoskosOwner,
+	}
+}
+
+// LocationOrder controls how LocationSelector orders candidate locations.
+type LocationOrder int
+
+const (
+	// Sticky tries candidates in the order they were given.
+	Sticky LocationOrder = iota
+	// RoundRobin starts from the candidate at index N (modulo the number of
+	// candidates) and wraps around.
+	RoundRobin
+	// Random shuffles candidates before trying them.
+	Random
+)
+
+// LocationResolver resolves a candidate location string (a GKE region or
+// zone) to a ClusterRef to attempt a deploy against. Implementations let
+// tests stub cluster resolution without hitting GCP.
+type LocationResolver interface {
+	Resolve(ctx context.Context, project, name, location string) (ClusterRef, error)
+}
+
+// LocationSelector orders a set of candidate locations and classifies errors
+// returned while attempting them, so CreateDeployer can fall back to the next
+// candidate on quota exhaustion instead of giving up.
+type LocationSelector struct {
+	Order LocationOrder
+	// N seeds RoundRobin's starting offset and Random's shuffle.
+	N int
+	// Resolver resolves each candidate location to a ClusterRef. Defaults to
+	// gkeLocationResolver, which makes no API call and assumes a cluster of
+	// the same name exists in each location.
+	Resolver LocationResolver
+}
+
+// order returns locations arranged per s.Order. A nil s is equivalent to
+// Sticky.
+func (s *LocationSelector) order(locations []string) []string {
+	if s == nil || s.Order == Sticky || len(locations) < 2 {
+		return locations
+	}
+	ordered := make([]string, len(locations))
+	copy(ordered, locations)
+	switch s.Order {
+	case RoundRobin:
+		offset := s.N % len(ordered)
+		ordered = append(ordered[offset:], ordered[:offset]...)
+	case Random:
+		r := rand.New(rand.NewSource(int64(s.N)))
+		r.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	}
+	return ordered
+}
+
+// retryableLocationError classifies errors that mean "try the next
+// location" rather than "fail the deploy". It matches the quota errors GKE
+// returns when a zone or region is out of capacity while resolving a
+// cluster's endpoint and credentials (the step this package controls) — it
+// says nothing about capacity errors the apply itself may later hit
+// scheduling pods or provisioning disks/load balancers in that location.
+func retryableLocationError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "RESOURCE_EXHAUSTED") || strings.Contains(msg, "ZONE_RESOURCE_POOL_EXHAUSTED")
+}
+
+// CreateDeployer creates a Deployer with initialized clients, plus a cleanup
+// func the caller must defer once the deploy outcome is known (success is
+// true if the deploy succeeded).
+//
+// When opts.UseGcloud is true, gcloud is shelled out to for both credentials
+// and cluster context resolution, as gke-deploy has always done. Otherwise
+// opts.AuthMode picks an in-process path to a rest.Config, so gke-deploy can
+// run from environments (Prow, Cloud Run, minimal containers) that don't ship
+// the gcloud SDK. GcloudInPath is advisory in this case, not load-bearing.
+//
+// If opts.Locations is set, each candidate is tried in turn (ordered by
+// opts.LocationSelector) before falling back to opts.BackupLocations, for
+// resolving cluster connectivity: looking up the cluster and building its
+// credentials/rest.Config. An error from one location only advances to the
+// next candidate when it looks like quota exhaustion; anything else is
+// returned immediately. This does not retry the manifest apply itself per
+// location — a capacity error surfacing during apply (e.g. the cluster
+// can't schedule pods or provision a load balancer) is the deployer
+// package's concern, not this connectivity fallback's.
+//
+// If opts.BoskosHost (or opts.Leaser) is set, a project is leased before the
+// cluster is resolved, heartbeat every 5 minutes until the cleanup func
+// cancels it, and released (dirty on failure, free on success) by the
+// cleanup func. This lets gke-deploy run against a Boskos-managed project
+// pool the way Prow's CI jobs do. Leasing is incompatible with
+// opts.UseGcloud: the gcloud shell-out resolves its own project from the
+// active gcloud config and has no path for a leased project to reach it.
+func CreateDeployer(ctx context.Context, opts DeployerOptions) (*deployer.Deployer, func(success bool), error) {
+	noop := func(bool) {}
+
+	leaser := opts.projectLeaser()
+	if leaser == nil {
+		d, err := createDeployer(ctx, opts)
+		return d, noop, err
+	}
+	if opts.UseGcloud {
+		return nil, noop, fmt.Errorf("DeployerOptions.UseGcloud is not compatible with project leasing (BoskosHost or Leaser): the leased project has no path into the gcloud shell-out")
+	}
+
+	return withLeasedProject(ctx, leaser, func(project string) (*deployer.Deployer, error) {
+		opts.Cluster.Project = project
+		return createDeployer(ctx, opts)
+	})
+}
+
+// withLeasedProject acquires a project from leaser, heartbeats it every 5
+// minutes until the returned cleanup func cancels it, and releases it
+// (dirty on failure, free on success) when that cleanup func runs. create is
+// called with the leased project once acquired. Split out from
+// CreateDeployer so the lease lifecycle can be tested against a fake
+// ProjectLeaser without exercising the GKE/client-go paths createDeployer
+// calls into.
+func withLeasedProject(ctx context.Context, leaser ProjectLeaser, create func(project string) (*deployer.Deployer, error)) (*deployer.Deployer, func(success bool), error) {
+	noop := func(bool) {}
+
+	project, err := leaser.Acquire(ctx)
+	if err != nil {
+		return nil, noop, fmt.Errorf("failed to acquire a project lease: %v", err)
+	}
+
+	hbCtx, cancelHeartbeat := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hbCtx.Done():
+				return
+			case <-ticker.C:
+				if err := leaser.Heartbeat(hbCtx, project); err != nil {
+					log.Printf("failed to heartbeat leased project %s: %v", project, err)
+				}
+			}
+		}
+	}()
+	cleanup := func(success bool) {
+		cancelHeartbeat()
+		if err := leaser.Release(context.Background(), project, !success); err != nil {
+			log.Printf("failed to release leased project %s: %v", project, err)
+		}
+	}
+
+	d, err := create(project)
+	if err != nil {
+		cleanup(false)
+		return nil, noop, err
+	}
+	return d, cleanup, nil
+}
+
+// createDeployer resolves opts (minus project leasing, already applied to
+// opts.Cluster.Project by the caller) to a Deployer.
+func createDeployer(ctx context.Context, opts DeployerOptions) (*deployer.Deployer, error) {
+	if opts.UseGcloud {
+		c, err := services.NewClients(ctx, true, opts.Verbose)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Clients: %v", err)
+		}
+		return newDeployer(c, true, opts), nil
+	}
+
+	if opts.AuthMode == Kubeconfig {
+		// Kubeconfig deploys have no cluster location to resolve, so they
+		// bypass the location-candidate loop entirely.
+		return createDeployerForLocation(ctx, opts, "")
+	}
+
+	candidates := opts.Locations
+	if len(candidates) == 0 {
+		candidates = []string{opts.Cluster.Location}
+	}
+
+	var errs []string
+	for _, group := range [][]string{opts.LocationSelector.order(candidates), opts.LocationSelector.order(opts.BackupLocations)} {
+		for _, location := range group {
+			d, err := createDeployerForLocation(ctx, opts, location)
+			if err == nil {
+				return d, nil
+			}
+			errs = append(errs, fmt.Sprintf("%s: %v", location, err))
+			if !retryableLocationError(err) {
+				return nil, fmt.Errorf("failed to deploy to %s: %v", location, err)
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to deploy to any candidate location: %s", strings.Join(errs, "; "))
+}
+
+// createDeployerForLocation resolves location to a cluster and builds a
+// Deployer against it.
+func createDeployerForLocation(ctx context.Context, opts DeployerOptions, location string) (*deployer.Deployer, error) {
+	cluster := opts.Cluster
+	cluster.Location = location
+	if opts.AuthMode != Kubeconfig {
+		resolver := opts.locationResolver()
+		ref, err := resolver.Resolve(ctx, opts.Cluster.Project, opts.Cluster.Name, location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve location %q: %v", location, err)
+		}
+		cluster = ref
+	}
+	opts.Cluster = cluster
+
+	cfg, err := restConfigForAuthMode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve cluster credentials: %v", err)
+	}
+	c, err := services.NewClientsFromConfig(ctx, cfg, opts.Verbose)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Clients: %v", err)
 	}
-	d := &deployer.Deployer{
-		Clients:   c,
-		UseGcloud: useGcloud,
+	return newDeployer(c, false, opts), nil
+}
+
+// newDeployer assembles a Deployer from an initialized Clients and the
+// application-namespacing options common to every CreateDeployer path.
+func newDeployer(c *services.Clients, useGcloud bool, opts DeployerOptions) *deployer.Deployer {
+	return &deployer.Deployer{
+		Clients:          c,
+		UseGcloud:        useGcloud,
+		AppNamespaceMode: deployer.AppNamespaceMode(opts.AppNamespaceMode),
+		AppNamespaces:    opts.AppNamespaces,
+		AppLinks:         opts.AppLinks,
+	}
+}
+
+// locationResolver returns opts.LocationSelector.Resolver, defaulting to
+// gkeLocationResolver{} when unset.
+func (opts DeployerOptions) locationResolver() LocationResolver {
+	if opts.LocationSelector != nil && opts.LocationSelector.Resolver != nil {
+		return opts.LocationSelector.Resolver
+	}
+	return gkeLocationResolver{}
+}
+
+// gkeLocationResolver resolves a location by assuming a cluster of the same
+// name exists there; CreateDeployer's own cluster lookup is what surfaces a
+// "not found" error if it doesn't.
+type gkeLocationResolver struct{}
+
+func (gkeLocationResolver) Resolve(ctx context.Context, project, name, location string) (ClusterRef, error) {
+	return ClusterRef{Project: project, Location: location, Name: name}, nil
+}
+
+// restConfigForAuthMode builds a rest.Config for opts.Cluster without
+// shelling out to gcloud, mirroring the credential/endpoint resolution that
+// legacy-cloud-providers/gce performs for its GKE clients.
+func restConfigForAuthMode(ctx context.Context, opts DeployerOptions) (*rest.Config, error) {
+	if opts.AuthMode == Kubeconfig {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if opts.KubeconfigPath != "" {
+			rules.ExplicitPath = opts.KubeconfigPath
+		}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+
+	var creds *google.Credentials
+	switch opts.AuthMode {
+	case ServiceAccountKey:
+		if opts.ServiceAccountKeyFile == "" {
+			return nil, fmt.Errorf("ServiceAccountKeyFile must be set for AuthMode ServiceAccountKey")
+		}
+		data, err := os.ReadFile(opts.ServiceAccountKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ServiceAccountKeyFile %q: %v", opts.ServiceAccountKeyFile, err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, container.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ServiceAccountKeyFile %q: %v", opts.ServiceAccountKeyFile, err)
+		}
+	case ADC:
+		var err error
+		creds, err = google.FindDefaultCredentials(ctx, container.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find credentials for AuthMode %v: %v", opts.AuthMode, err)
+		}
+	case WorkloadIdentity:
+		// Workload Identity tokens come from the GKE metadata server.
+		creds = &google.Credentials{TokenSource: google.ComputeTokenSource("", container.CloudPlatformScope)}
+	default:
+		return nil, fmt.Errorf("unsupported AuthMode %v", opts.AuthMode)
+	}
+
+	var clientOpts []option.ClientOption
+	clientOpts = append(clientOpts, option.WithTokenSource(creds.TokenSource))
+
+	svc, err := container.NewService(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container service: %v", err)
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", opts.Cluster.Project, opts.Cluster.Location, opts.Cluster.Name)
+	cluster, err := svc.Projects.Locations.Clusters.Get(name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster %q: %v", name, err)
 	}
-	return d, nil
+	ca, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cluster CA certificate: %v", err)
+	}
+
+	return &rest.Config{
+		Host: "https://" + cluster.Endpoint,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: ca,
+		},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return &oauth2.Transport{Source: creds.TokenSource, Base: rt}
+		},
+	}, nil
 }
 
 // SuggestedOutputPath takes a root output directory and returns the path where
-// suggested configs should be stored.
+// suggested configs should be stored. Pass the result to NewManifestStore to
+// stage suggested configs to a gs://, s3://, or local file:// destination.
 func SuggestedOutputPath(root string) string {
 	return join(root, "suggested")
 }
 
 // ExpandedOutputPath takes a root output directory and returns the path where
-// expanded configs should be stored.
+// expanded configs should be stored. Pass the result to NewManifestStore to
+// stage expanded configs to a gs://, s3://, or local file:// destination.
 func ExpandedOutputPath(root string) string {
 	return join(root, "expanded")
 }
 
-// GcloudInPath returns true if the `gcloud` command is in this machine's PATH.
+// GcloudInPath returns true if the `gcloud` command is in this machine's
+// PATH. This is only load-bearing when DeployerOptions.UseGcloud is true; for
+// every other AuthMode it's advisory information callers may surface in a
+// warning, since CreateDeployer never shells out to gcloud in that case.
 func GcloudInPath() bool {
 	if _, err := exec.LookPath("gcloud"); err != nil {
 		return false
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gke-deploy/deployer"
+	applicationsv1beta1 "github.com/kubernetes-sigs/application/pkg/apis/app/v1beta1"
+)
+
+// fakeLeaser is a ProjectLeaser that records its calls instead of leasing a
+// real Boskos resource, so CreateDeployer's lease/heartbeat/release
+// orchestration can be tested without a Boskos server.
+type fakeLeaser struct {
+	acquireProject string
+	acquireErr     error
+
+	mu             sync.Mutex
+	acquireCalls   int
+	heartbeatCalls int
+	releases       []struct {
+		project string
+		dirty   bool
+	}
+}
+
+func (l *fakeLeaser) Acquire(ctx context.Context) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acquireCalls++
+	if l.acquireErr != nil {
+		return "", l.acquireErr
+	}
+	return l.acquireProject, nil
+}
+
+func (l *fakeLeaser) Heartbeat(ctx context.Context, project string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.heartbeatCalls++
+	return nil
+}
+
+func (l *fakeLeaser) Release(ctx context.Context, project string, dirty bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releases = append(l.releases, struct {
+		project string
+		dirty   bool
+	}{project, dirty})
+	return nil
+}
+
+func TestCreateDeployerRejectsUseGcloudWithLeasing(t *testing.T) {
+	l := &fakeLeaser{acquireProject: "leased-project"}
+
+	_, _, err := CreateDeployer(context.Background(), DeployerOptions{
+		UseGcloud: true,
+		Leaser:    l,
+	})
+	if err == nil {
+		t.Fatal("CreateDeployer() with UseGcloud and a Leaser returned no error")
+	}
+	if l.acquireCalls != 0 {
+		t.Errorf("Acquire() called %d times, want 0", l.acquireCalls)
+	}
+}
+
+func TestWithLeasedProjectSuccessReleasesFree(t *testing.T) {
+	l := &fakeLeaser{acquireProject: "leased-project"}
+	want := &deployer.Deployer{}
+
+	d, cleanup, err := withLeasedProject(context.Background(), l, func(project string) (*deployer.Deployer, error) {
+		if project != "leased-project" {
+			t.Errorf("create called with project %q, want %q", project, "leased-project")
+		}
+		return want, nil
+	})
+	if err != nil {
+		t.Fatalf("withLeasedProject() returned error: %v", err)
+	}
+	if d != want {
+		t.Errorf("withLeasedProject() deployer = %v, want %v", d, want)
+	}
+
+	cleanup(true)
+
+	if len(l.releases) != 1 {
+		t.Fatalf("Release() called %d times, want 1", len(l.releases))
+	}
+	if l.releases[0].project != "leased-project" || l.releases[0].dirty {
+		t.Errorf("Release() = %+v, want {leased-project false}", l.releases[0])
+	}
+}
+
+func TestWithLeasedProjectCreateFailureReleasesDirty(t *testing.T) {
+	l := &fakeLeaser{acquireProject: "leased-project"}
+	createErr := fmt.Errorf("boom")
+
+	_, _, err := withLeasedProject(context.Background(), l, func(project string) (*deployer.Deployer, error) {
+		return nil, createErr
+	})
+	if err == nil {
+		t.Fatal("withLeasedProject() returned no error")
+	}
+
+	if len(l.releases) != 1 {
+		t.Fatalf("Release() called %d times, want 1", len(l.releases))
+	}
+	if l.releases[0].project != "leased-project" || !l.releases[0].dirty {
+		t.Errorf("Release() = %+v, want {leased-project true}", l.releases[0])
+	}
+}
+
+func TestWithLeasedProjectAcquireFailureSkipsHeartbeatAndCreate(t *testing.T) {
+	l := &fakeLeaser{acquireErr: fmt.Errorf("no projects available")}
+	createCalled := false
+
+	d, cleanup, err := withLeasedProject(context.Background(), l, func(project string) (*deployer.Deployer, error) {
+		createCalled = true
+		return nil, nil
+	})
+	if err == nil {
+		t.Fatal("withLeasedProject() returned no error")
+	}
+	if d != nil {
+		t.Errorf("withLeasedProject() deployer = %v, want nil", d)
+	}
+	if createCalled {
+		t.Error("withLeasedProject() called create after a failed Acquire")
+	}
+
+	// The returned cleanup is a noop: calling it must not reach the
+	// leaser, which is how we know the heartbeat goroutine (started only
+	// after a successful Acquire, and torn down only by a leaser-bound
+	// cleanup) was never spun up.
+	cleanup(true)
+	if l.heartbeatCalls != 0 {
+		t.Errorf("Heartbeat() called %d times, want 0", l.heartbeatCalls)
+	}
+	if len(l.releases) != 0 {
+		t.Errorf("Release() called %d times, want 0", len(l.releases))
+	}
+}
+
+func TestLocationSelectorOrder(t *testing.T) {
+	locations := []string{"us-central1", "us-east1", "us-west1"}
+
+	tests := []struct {
+		name     string
+		selector *LocationSelector
+		want     []string
+	}{
+		{
+			name:     "nil selector is sticky",
+			selector: nil,
+			want:     []string{"us-central1", "us-east1", "us-west1"},
+		},
+		{
+			name:     "sticky keeps the given order",
+			selector: &LocationSelector{Order: Sticky},
+			want:     []string{"us-central1", "us-east1", "us-west1"},
+		},
+		{
+			name:     "round robin rotates by N",
+			selector: &LocationSelector{Order: RoundRobin, N: 1},
+			want:     []string{"us-east1", "us-west1", "us-central1"},
+		},
+		{
+			name:     "round robin wraps N",
+			selector: &LocationSelector{Order: RoundRobin, N: 4},
+			want:     []string{"us-east1", "us-west1", "us-central1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.selector.order(locations)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("order(%v) = %v, want %v", locations, got, tc.want)
+			}
+			if !reflect.DeepEqual(locations, []string{"us-central1", "us-east1", "us-west1"}) {
+				t.Errorf("order() mutated its input slice: %v", locations)
+			}
+		})
+	}
+}
+
+func TestLocationSelectorOrderRandomIsAPermutation(t *testing.T) {
+	locations := []string{"us-central1", "us-east1", "us-west1", "europe-west1"}
+	got := (&LocationSelector{Order: Random, N: 7}).order(locations)
+
+	if len(got) != len(locations) {
+		t.Fatalf("order() returned %d locations, want %d", len(got), len(locations))
+	}
+	seen := make(map[string]bool)
+	for _, l := range got {
+		seen[l] = true
+	}
+	for _, l := range locations {
+		if !seen[l] {
+			t.Errorf("order() dropped location %q", l)
+		}
+	}
+}
+
+func TestCreateApplicationLinksMapFromEqualDelimitedStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    map[string][]applicationsv1beta1.Link
+		wantErr bool
+	}{
+		{
+			name:  "namespaced link",
+			input: []string{"team-a/docs=https://example.com/docs"},
+			want: map[string][]applicationsv1beta1.Link{
+				"team-a": {{Description: "docs", URL: "https://example.com/docs"}},
+			},
+		},
+		{
+			name:  "unnamespaced link with a slash in its URL value",
+			input: []string{"docs=https://example.com/docs/path"},
+			want: map[string][]applicationsv1beta1.Link{
+				"": {{Description: "docs", URL: "https://example.com/docs/path"}},
+			},
+		},
+		{
+			name:  "namespace segment is trimmed",
+			input: []string{"team-a /docs=https://example.com"},
+			want: map[string][]applicationsv1beta1.Link{
+				"team-a": {{Description: "docs", URL: "https://example.com"}},
+			},
+		},
+		{
+			name:  "mixed namespaced and cluster-wide entries",
+			input: []string{"team-a/docs=https://a.example.com", "docs=https://cluster.example.com"},
+			want: map[string][]applicationsv1beta1.Link{
+				"team-a": {{Description: "docs", URL: "https://a.example.com"}},
+				"":       {{Description: "docs", URL: "https://cluster.example.com"}},
+			},
+		},
+		{
+			name:    "missing equals sign",
+			input:   []string{"team-a/docs"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CreateApplicationLinksMapFromEqualDelimitedStrings(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("CreateApplicationLinksMapFromEqualDelimitedStrings(%v) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("CreateApplicationLinksMapFromEqualDelimitedStrings(%v) = %v, want %v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryableLocationError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("rpc error: RESOURCE_EXHAUSTED: quota exceeded"), true},
+		{fmt.Errorf("rpc error: ZONE_RESOURCE_POOL_EXHAUSTED: no capacity"), true},
+		{fmt.Errorf("cluster not found"), false},
+		{fmt.Errorf("permission denied"), false},
+	}
+	for _, tc := range tests {
+		if got := retryableLocationError(tc.err); got != tc.want {
+			t.Errorf("retryableLocationError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ManifestStore persists the manifest files a gke-deploy run expands or
+// suggests, so a later pipeline stage (e.g. `gke-deploy apply` reading what
+// an earlier `gke-deploy prepare` staged) can read them back from the same
+// URL. Implementations are chosen by NewManifestStore based on the root
+// output path's URL scheme.
+type ManifestStore interface {
+	// Put streams content to a content-hash-addressed location under name
+	// and returns the URL it was stored at.
+	Put(ctx context.Context, name string, content io.Reader) (string, error)
+}
+
+// ManifestStoreOptions configures NewManifestStore.
+type ManifestStoreOptions struct {
+	// RunID, if set, is inserted as a path segment beneath root so
+	// concurrent runs don't collide, e.g.
+	// "gs://my-artifacts/pulls/<pr>/expanded/<RunID>/deployment-<hash>.yaml".
+	// See RunID.
+	RunID string
+	// LifecycleDays auto-expires stored objects after this many days.
+	// Ignored by the file:// store; 0 disables lifecycle management.
+	LifecycleDays int
+	// GCSProjectID is the project to create the bucket in if it doesn't
+	// already exist. Required for gs:// roots whose bucket doesn't exist
+	// yet; ignored by the s3:// and file:// stores.
+	GCSProjectID string
+}
+
+// RunID returns a value suitable for ManifestStoreOptions.RunID, taken from
+// whichever CI-assigned build identifier is set in the environment, so
+// concurrent runs land in distinct manifest store subdirectories without
+// any extra coordination. It returns "" outside of a recognized CI
+// environment.
+func RunID() string {
+	for _, key := range []string{"BUILD_ID", "PROW_JOB_ID", "BUILD_NUMBER"} {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// NewManifestStore returns the ManifestStore for root's URL scheme: gs://
+// for GCS, s3:// for S3, and file:// (or no scheme) for local disk. GCS and
+// S3 buckets are created automatically if they don't already exist, with a
+// lifecycle rule expiring objects after opts.LifecycleDays when it's
+// non-zero.
+func NewManifestStore(ctx context.Context, root string, opts ManifestStoreOptions) (ManifestStore, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest store root %q: %v", root, err)
+	}
+	switch u.Scheme {
+	case "gs":
+		return newGCSManifestStore(ctx, u, opts)
+	case "s3":
+		return newS3ManifestStore(ctx, u, opts)
+	case "", "file":
+		return &fileManifestStore{root: u.Path, opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("unsupported manifest store scheme %q", u.Scheme)
+	}
+}
+
+// hashedPut spools content to a temp file on disk while hashing it, then
+// calls upload with a content-hash-addressed object name and the spooled
+// file rewound to its start. Spooling to disk, rather than buffering in
+// memory, is what lets large manifest sets be content-addressed without
+// needing the whole set resident in RAM at once.
+func hashedPut(name string, content io.Reader, upload func(objectName string, spooled *os.File) error) (string, error) {
+	tmp, err := os.CreateTemp("", "gke-deploy-manifest-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create spool file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(content, h)); err != nil {
+		return "", fmt.Errorf("failed to spool %q: %v", name, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind spool file: %v", err)
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(path.Base(name), ext)
+	objectName := fmt.Sprintf("%s-%s%s", base, hex.EncodeToString(h.Sum(nil))[:16], ext)
+
+	if err := upload(objectName, tmp); err != nil {
+		return "", err
+	}
+	return objectName, nil
+}
+
+// fileManifestStore stores manifests on local disk, under root (and
+// opts.RunID, if set).
+type fileManifestStore struct {
+	root string
+	opts ManifestStoreOptions
+}
+
+func (s *fileManifestStore) Put(ctx context.Context, name string, content io.Reader) (string, error) {
+	dir := s.root
+	if s.opts.RunID != "" {
+		dir = filepath.Join(dir, s.opts.RunID)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create manifest store directory %q: %v", dir, err)
+	}
+	objectName, err := hashedPut(name, content, func(objectName string, spooled *os.File) error {
+		dst, err := os.Create(filepath.Join(dir, objectName))
+		if err != nil {
+			return fmt.Errorf("failed to create %q: %v", objectName, err)
+		}
+		defer dst.Close()
+		_, err = io.Copy(dst, spooled)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.Join(dir, objectName), nil
+}
+
+// gcsManifestStore stores manifests in a GCS bucket.
+type gcsManifestStore struct {
+	client *storage.Client
+	bucket string
+	prefix string
+	opts   ManifestStoreOptions
+}
+
+func newGCSManifestStore(ctx context.Context, u *url.URL, opts ManifestStoreOptions) (ManifestStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	bucket := u.Host
+	if err := ensureGCSBucket(ctx, client.Bucket(bucket), bucket, opts.GCSProjectID, opts.LifecycleDays); err != nil {
+		return nil, err
+	}
+	return &gcsManifestStore{
+		client: client,
+		bucket: bucket,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		opts:   opts,
+	}, nil
+}
+
+// gcsBucketHandle is the subset of *storage.BucketHandle that
+// ensureGCSBucket needs, so tests can exercise its exists/create/lifecycle
+// decisions with a fake instead of a live GCS connection.
+type gcsBucketHandle interface {
+	Attrs(ctx context.Context) (*storage.BucketAttrs, error)
+	Create(ctx context.Context, projectID string, attrs *storage.BucketAttrs) error
+	Update(ctx context.Context, uattrs storage.BucketAttrsToUpdate) (*storage.BucketAttrs, error)
+}
+
+func gcsLifecycle(lifecycleDays int) storage.Lifecycle {
+	return storage.Lifecycle{
+		Rules: []storage.LifecycleRule{
+			{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: int64(lifecycleDays)},
+			},
+		},
+	}
+}
+
+// ensureGCSBucket makes sure bucket exists, creating it in projectID if it
+// doesn't, and applies a lifecycleDays expiry rule either way — on an
+// already-existing bucket as an Update, on a newly created one as part of
+// Create — so LifecycleDays behaves the same regardless of whether the
+// bucket pre-dates this run.
+func ensureGCSBucket(ctx context.Context, bucket gcsBucketHandle, name, projectID string, lifecycleDays int) error {
+	if _, err := bucket.Attrs(ctx); err == nil {
+		if lifecycleDays <= 0 {
+			return nil
+		}
+		lifecycle := gcsLifecycle(lifecycleDays)
+		if _, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle}); err != nil {
+			return fmt.Errorf("failed to set lifecycle on bucket %q: %v", name, err)
+		}
+		return nil
+	} else if err != storage.ErrBucketNotExist {
+		return fmt.Errorf("failed to inspect bucket %q: %v", name, err)
+	}
+	if projectID == "" {
+		return fmt.Errorf("bucket %q does not exist and GCSProjectID was not set to create it", name)
+	}
+	attrs := &storage.BucketAttrs{}
+	if lifecycleDays > 0 {
+		attrs.Lifecycle = gcsLifecycle(lifecycleDays)
+	}
+	if err := bucket.Create(ctx, projectID, attrs); err != nil {
+		return fmt.Errorf("failed to create bucket %q in project %q: %v", name, projectID, err)
+	}
+	return nil
+}
+
+func (s *gcsManifestStore) Put(ctx context.Context, name string, content io.Reader) (string, error) {
+	dir := s.prefix
+	if s.opts.RunID != "" {
+		dir = path.Join(dir, s.opts.RunID)
+	}
+	objectName, err := hashedPut(name, content, func(objectName string, spooled *os.File) error {
+		w := s.client.Bucket(s.bucket).Object(path.Join(dir, objectName)).NewWriter(ctx)
+		if _, err := io.Copy(w, spooled); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to upload %q: %v", objectName, err)
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", s.bucket, path.Join(dir, objectName)), nil
+}
+
+// s3ManifestStore stores manifests in an S3 bucket.
+type s3ManifestStore struct {
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	opts     ManifestStoreOptions
+}
+
+func newS3ManifestStore(ctx context.Context, u *url.URL, opts ManifestStoreOptions) (ManifestStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	client := s3.NewFromConfig(cfg)
+	bucket := u.Host
+	if err := ensureS3Bucket(ctx, client, bucket, opts.LifecycleDays); err != nil {
+		return nil, err
+	}
+	return &s3ManifestStore{
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+		opts:     opts,
+	}, nil
+}
+
+// s3BucketAPI is the subset of *s3.Client that ensureS3Bucket needs, so
+// tests can exercise its exists/create/lifecycle decisions with a fake
+// instead of a live S3 connection.
+type s3BucketAPI interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error)
+}
+
+func ensureS3Bucket(ctx context.Context, client s3BucketAPI, bucket string, lifecycleDays int) error {
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return setS3Lifecycle(ctx, client, bucket, lifecycleDays)
+	}
+	var notFound *types.NotFound
+	var apiErr smithy.APIError
+	if !errors.As(err, &notFound) && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+		return fmt.Errorf("failed to inspect bucket %q: %v", bucket, err)
+	}
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return fmt.Errorf("failed to create bucket %q: %v", bucket, err)
+	}
+	return setS3Lifecycle(ctx, client, bucket, lifecycleDays)
+}
+
+func setS3Lifecycle(ctx context.Context, client s3BucketAPI, bucket string, lifecycleDays int) error {
+	if lifecycleDays <= 0 {
+		return nil
+	}
+	_, err := client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: []types.LifecycleRule{
+				{
+					Status:     types.ExpirationStatusEnabled,
+					Expiration: &types.LifecycleExpiration{Days: aws.Int32(int32(lifecycleDays))},
+					Filter:     &types.LifecycleRuleFilterMemberPrefix{Value: ""},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle on bucket %q: %v", bucket, err)
+	}
+	return nil
+}
+
+func (s *s3ManifestStore) Put(ctx context.Context, name string, content io.Reader) (string, error) {
+	dir := s.prefix
+	if s.opts.RunID != "" {
+		dir = path.Join(dir, s.opts.RunID)
+	}
+	objectName, err := hashedPut(name, content, func(objectName string, spooled *os.File) error {
+		key := path.Join(dir, objectName)
+		if _, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Body:   spooled,
+		}); err != nil {
+			return fmt.Errorf("failed to upload %q: %v", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, path.Join(dir, objectName)), nil
+}
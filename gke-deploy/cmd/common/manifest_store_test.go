@@ -0,0 +1,248 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestNewManifestStoreFileScheme(t *testing.T) {
+	for _, root := range []string{"/tmp/gke-deploy-test", "file:///tmp/gke-deploy-test"} {
+		store, err := NewManifestStore(context.Background(), root, ManifestStoreOptions{})
+		if err != nil {
+			t.Fatalf("NewManifestStore(%q) returned error: %v", root, err)
+		}
+		if _, ok := store.(*fileManifestStore); !ok {
+			t.Errorf("NewManifestStore(%q) = %T, want *fileManifestStore", root, store)
+		}
+	}
+}
+
+func TestNewManifestStoreUnsupportedScheme(t *testing.T) {
+	if _, err := NewManifestStore(context.Background(), "ftp://example.com/root", ManifestStoreOptions{}); err == nil {
+		t.Error("NewManifestStore() with an ftp:// root returned nil error, want an error")
+	}
+}
+
+func TestFileManifestStorePut(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewManifestStore(context.Background(), dir, ManifestStoreOptions{RunID: "run-1"})
+	if err != nil {
+		t.Fatalf("NewManifestStore() returned error: %v", err)
+	}
+
+	loc, err := store.Put(context.Background(), "deployment.yaml", strings.NewReader("kind: Deployment\n"))
+	if err != nil {
+		t.Fatalf("Put() returned error: %v", err)
+	}
+
+	wantPrefix := "file://" + filepath.Join(dir, "run-1")
+	if !strings.HasPrefix(loc, wantPrefix) {
+		t.Errorf("Put() = %q, want prefix %q", loc, wantPrefix)
+	}
+	if !strings.Contains(loc, "deployment-") || !strings.HasSuffix(loc, ".yaml") {
+		t.Errorf("Put() = %q, want a content-hash-addressed deployment-<hash>.yaml name", loc)
+	}
+
+	path := strings.TrimPrefix(loc, "file://")
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read stored manifest at %q: %v", path, err)
+	}
+	if string(got) != "kind: Deployment\n" {
+		t.Errorf("stored content = %q, want %q", got, "kind: Deployment\n")
+	}
+}
+
+func TestFileManifestStorePutIsContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewManifestStore(context.Background(), dir, ManifestStoreOptions{})
+	if err != nil {
+		t.Fatalf("NewManifestStore() returned error: %v", err)
+	}
+
+	loc1, err := store.Put(context.Background(), "a.yaml", strings.NewReader("same content"))
+	if err != nil {
+		t.Fatalf("Put() returned error: %v", err)
+	}
+	loc2, err := store.Put(context.Background(), "b.yaml", strings.NewReader("same content"))
+	if err != nil {
+		t.Fatalf("Put() returned error: %v", err)
+	}
+	if filepath.Base(loc1) != strings.Replace(filepath.Base(loc2), "b-", "a-", 1) {
+		t.Errorf("Put() names for identical content diverged: %q vs %q", loc1, loc2)
+	}
+
+	loc3, err := store.Put(context.Background(), "a.yaml", strings.NewReader("different content"))
+	if err != nil {
+		t.Fatalf("Put() returned error: %v", err)
+	}
+	if loc1 == loc3 {
+		t.Errorf("Put() returned the same location for different content: %q", loc1)
+	}
+}
+
+// fakeGCSBucket is a gcsBucketHandle that records whether Update/Create were
+// called, without making a live GCS connection.
+type fakeGCSBucket struct {
+	exists          bool
+	attrsErr        error
+	createErr       error
+	updateErr       error
+	createCalled    bool
+	updateCalled    bool
+	createAttrs     *storage.BucketAttrs
+	updateLifecycle *storage.Lifecycle
+}
+
+func (b *fakeGCSBucket) Attrs(ctx context.Context) (*storage.BucketAttrs, error) {
+	if b.attrsErr != nil {
+		return nil, b.attrsErr
+	}
+	if !b.exists {
+		return nil, storage.ErrBucketNotExist
+	}
+	return &storage.BucketAttrs{}, nil
+}
+
+func (b *fakeGCSBucket) Create(ctx context.Context, projectID string, attrs *storage.BucketAttrs) error {
+	b.createCalled = true
+	b.createAttrs = attrs
+	return b.createErr
+}
+
+func (b *fakeGCSBucket) Update(ctx context.Context, uattrs storage.BucketAttrsToUpdate) (*storage.BucketAttrs, error) {
+	b.updateCalled = true
+	b.updateLifecycle = uattrs.Lifecycle
+	return &storage.BucketAttrs{}, b.updateErr
+}
+
+func TestEnsureGCSBucketAppliesLifecycleWhenBucketAlreadyExists(t *testing.T) {
+	b := &fakeGCSBucket{exists: true}
+	if err := ensureGCSBucket(context.Background(), b, "my-bucket", "", 30); err != nil {
+		t.Fatalf("ensureGCSBucket() returned error: %v", err)
+	}
+	if b.createCalled {
+		t.Error("ensureGCSBucket() called Create on a bucket that already exists")
+	}
+	if !b.updateCalled {
+		t.Error("ensureGCSBucket() did not call Update to set lifecycle on an already-existing bucket")
+	}
+	if b.updateLifecycle == nil || len(b.updateLifecycle.Rules) != 1 {
+		t.Errorf("ensureGCSBucket() Update lifecycle = %v, want one rule", b.updateLifecycle)
+	}
+}
+
+func TestEnsureGCSBucketSkipsLifecycleUpdateWhenUnset(t *testing.T) {
+	b := &fakeGCSBucket{exists: true}
+	if err := ensureGCSBucket(context.Background(), b, "my-bucket", "", 0); err != nil {
+		t.Fatalf("ensureGCSBucket() returned error: %v", err)
+	}
+	if b.updateCalled {
+		t.Error("ensureGCSBucket() called Update when LifecycleDays was 0")
+	}
+}
+
+func TestEnsureGCSBucketCreatesMissingBucketWithLifecycle(t *testing.T) {
+	b := &fakeGCSBucket{exists: false}
+	if err := ensureGCSBucket(context.Background(), b, "my-bucket", "my-project", 30); err != nil {
+		t.Fatalf("ensureGCSBucket() returned error: %v", err)
+	}
+	if !b.createCalled {
+		t.Error("ensureGCSBucket() did not call Create for a missing bucket")
+	}
+	if b.createAttrs == nil || len(b.createAttrs.Lifecycle.Rules) != 1 {
+		t.Errorf("ensureGCSBucket() Create attrs = %v, want one lifecycle rule", b.createAttrs)
+	}
+}
+
+func TestEnsureGCSBucketMissingWithoutProjectID(t *testing.T) {
+	b := &fakeGCSBucket{exists: false}
+	if err := ensureGCSBucket(context.Background(), b, "my-bucket", "", 0); err == nil {
+		t.Error("ensureGCSBucket() with a missing bucket and no GCSProjectID returned nil error, want an error")
+	}
+	if b.createCalled {
+		t.Error("ensureGCSBucket() called Create despite an empty projectID")
+	}
+}
+
+func TestEnsureGCSBucketPropagatesInspectErrors(t *testing.T) {
+	b := &fakeGCSBucket{attrsErr: errors.New("permission denied")}
+	if err := ensureGCSBucket(context.Background(), b, "my-bucket", "my-project", 0); err == nil {
+		t.Error("ensureGCSBucket() swallowed a non-not-exist Attrs error")
+	}
+	if b.createCalled {
+		t.Error("ensureGCSBucket() called Create after a non-not-exist Attrs error")
+	}
+}
+
+// fakeS3BucketAPI is an s3BucketAPI that records whether CreateBucket/
+// PutBucketLifecycleConfiguration were called, without making a live S3
+// connection.
+type fakeS3BucketAPI struct {
+	headErr         error
+	createCalled    bool
+	lifecycleCalled bool
+}
+
+func (f *fakeS3BucketAPI) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if f.headErr != nil {
+		return nil, f.headErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3BucketAPI) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	f.createCalled = true
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (f *fakeS3BucketAPI) PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	f.lifecycleCalled = true
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func TestEnsureS3BucketAppliesLifecycleWhenBucketAlreadyExists(t *testing.T) {
+	f := &fakeS3BucketAPI{}
+	if err := ensureS3Bucket(context.Background(), f, "my-bucket", 30); err != nil {
+		t.Fatalf("ensureS3Bucket() returned error: %v", err)
+	}
+	if f.createCalled {
+		t.Error("ensureS3Bucket() called CreateBucket on a bucket that already exists")
+	}
+	if !f.lifecycleCalled {
+		t.Error("ensureS3Bucket() did not set lifecycle on an already-existing bucket")
+	}
+}
+
+func TestEnsureS3BucketCreatesMissingBucketWithLifecycle(t *testing.T) {
+	notFound := &types.NotFound{}
+	f := &fakeS3BucketAPI{headErr: notFound}
+	if err := ensureS3Bucket(context.Background(), f, "my-bucket", 30); err != nil {
+		t.Fatalf("ensureS3Bucket() returned error: %v", err)
+	}
+	if !f.createCalled {
+		t.Error("ensureS3Bucket() did not call CreateBucket for a missing bucket")
+	}
+	if !f.lifecycleCalled {
+		t.Error("ensureS3Bucket() did not set lifecycle on a newly created bucket")
+	}
+}
+
+func TestEnsureS3BucketPropagatesInspectErrors(t *testing.T) {
+	f := &fakeS3BucketAPI{headErr: errors.New("permission denied")}
+	if err := ensureS3Bucket(context.Background(), f, "my-bucket", 0); err == nil {
+		t.Error("ensureS3Bucket() swallowed a non-not-found HeadBucket error")
+	}
+	if f.createCalled {
+		t.Error("ensureS3Bucket() called CreateBucket after a non-not-found HeadBucket error")
+	}
+}